@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueuesManagerAckRemovesInFlight(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Minute, 0)
+
+	if err := qm.Put("q", "a", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	id, v, err := qm.Get(context.Background(), "q", nil, "", 0)
+	if err != nil || v != "a" {
+		t.Fatalf("Get() = %q, %v; want \"a\", nil", v, err)
+	}
+
+	if err := qm.Ack("q", id); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := qm.Ack("q", id); err == nil {
+		t.Fatal("Ack() on already-acked id = nil error; want error")
+	}
+}
+
+func TestQueuesManagerRedeliversUnackedAfterVisibilityExpires(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, 50*time.Millisecond, 0)
+
+	if err := qm.Put("q", "a", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	_, v, err := qm.Get(context.Background(), "q", nil, "", 0)
+	if err != nil || v != "a" {
+		t.Fatalf("Get() = %q, %v; want \"a\", nil", v, err)
+	}
+
+	timeout := 2 * time.Second
+	_, v, err = qm.Get(context.Background(), "q", &timeout, "", 0)
+	if err != nil || v != "a" {
+		t.Fatalf("Get() after redelivery = %q, %v; want \"a\", nil", v, err)
+	}
+}
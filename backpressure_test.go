@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueuesManagerPutRejectsOverMaxLen(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	maxlen := 2
+	if err := qm.Put("q", "a", nil, "", &maxlen); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := qm.Put("q", "b", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	err := qm.Put("q", "c", nil, "", nil)
+	var full *ErrQueueFull
+	if !errors.As(err, &full) {
+		t.Fatalf("Put() on full queue = %v; want *ErrQueueFull", err)
+	}
+
+	stats, serr := qm.Stats("q")
+	if serr != nil {
+		t.Fatalf("Stats: %v", serr)
+	}
+	if stats.Length != 2 {
+		t.Fatalf("Stats().Length = %d; want 2", stats.Length)
+	}
+	if stats.Drops != 1 {
+		t.Fatalf("Stats().Drops = %d; want 1", stats.Drops)
+	}
+}
+
+func TestQueuesManagerDefaultMaxLenIsUnlimited(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	for i := 0; i < 10; i++ {
+		if err := qm.Put("q", "v", nil, "", nil); err != nil {
+			t.Fatalf("Put #%d: %v", i, err)
+		}
+	}
+
+	stats, err := qm.Stats("q")
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Length != 10 {
+		t.Fatalf("Stats().Length = %d; want 10", stats.Length)
+	}
+	if stats.Drops != 0 {
+		t.Fatalf("Stats().Drops = %d; want 0", stats.Drops)
+	}
+}
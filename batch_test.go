@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueuesManagerGetNReturnsUpToN(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	for _, v := range []string{"a", "b", "c"} {
+		if err := qm.Put("q", v, nil, "", nil); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	items, err := qm.GetN(context.Background(), "q", 2, nil, "", 0)
+	if err != nil {
+		t.Fatalf("GetN: %v", err)
+	}
+	if len(items) != 2 || items[0].Value != "a" || items[1].Value != "b" {
+		t.Fatalf("GetN() = %+v; want [a b]", items)
+	}
+
+	items, err = qm.GetN(context.Background(), "q", 5, nil, "", 0)
+	if err != nil {
+		t.Fatalf("GetN: %v", err)
+	}
+	if len(items) != 1 || items[0].Value != "c" {
+		t.Fatalf("GetN() = %+v; want [c]", items)
+	}
+}
+
+func TestQueuesManagerGetNWaitsForFirstMessage(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	timeout := 2 * time.Second
+	result := make(chan []BatchItem, 1)
+	go func() {
+		items, err := qm.GetN(context.Background(), "q", 5, &timeout, "", 0)
+		if err != nil {
+			t.Errorf("GetN: %v", err)
+			return
+		}
+		result <- items
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := qm.Put("q", "a", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	select {
+	case items := <-result:
+		if len(items) != 1 || items[0].Value != "a" {
+			t.Fatalf("GetN() = %+v; want [a]", items)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetN did not unblock after Put")
+	}
+}
+
+// TestQueuesManagerGetDoesNotMissConcurrentPut - регрессионный тест на
+// lost wakeup: Put, выполненный сразу после того, как Get проверил, что
+// сообщений нет, должен достаться именно этому ожидающему Get, а не
+// осесть в store до истечения таймаута.
+func TestQueuesManagerGetDoesNotMissConcurrentPut(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	timeout := 200 * time.Millisecond
+	result := make(chan string, 1)
+	go func() {
+		_, v, err := qm.Get(context.Background(), "q", &timeout, "", 0)
+		if err != nil {
+			t.Errorf("Get: %v", err)
+			return
+		}
+		result <- v
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := qm.Put("q", "a", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	select {
+	case v := <-result:
+		if v != "a" {
+			t.Fatalf("Get() = %q; want \"a\"", v)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Get missed a concurrent Put and timed out instead of receiving it")
+	}
+}
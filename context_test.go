@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestQueuesManagerGetCancelledByContext убеждается, что Get прерывает
+// ожидание по отмене ctx, не дожидаясь timeout, и убирает слушателя из
+// очереди, а не оставляет его висеть.
+func TestQueuesManagerGetCancelledByContext(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timeout := 10 * time.Second
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(done)
+		_, v, err := qm.Get(ctx, "q", &timeout, "", 0)
+		if err != nil {
+			t.Errorf("Get: %v", err)
+		}
+		if v != "" {
+			t.Errorf("Get() = %q; want \"\" after cancellation", v)
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Get took %v to return after ctx cancellation, should be near-instant", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get did not return after ctx cancellation")
+	}
+
+	stats, err := qm.Stats("q")
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Listeners != 0 {
+		t.Fatalf("Stats().Listeners = %d; want 0, cancelled listener should be removed", stats.Listeners)
+	}
+}
@@ -1,16 +1,19 @@
 // Пакет реализует очередь сообщений.
 // Предусмотренна возможность ожидания нового значения, если очередь пуста.
 // Так же есть возможность указать порт первым аргументом строки.
+// Флагом -db задается путь к файлу персистентного хранилища (embedded KV store);
+// если флаг не указан, используется хранилище в памяти и данные не переживают перезапуск.
 package main
 
 import (
-	"container/list"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
@@ -18,168 +21,251 @@ var (
 	defaultPort       = 9090
 	putValueHTTPKey   = "v"
 	getTimeoutHTTPKey = "timeout"
+	getNHTTPKey       = "n"
+	priorityHTTPKey   = "priority"
+	modeHTTPKey       = "mode"
+	visibilityHTTPKey = "visibility"
+	maxlenHTTPKey     = "maxlen"
+	ackIDHTTPKey      = "id"
+	ackPathSuffix     = "/ack"
+	streamPathSuffix  = "/stream"
+	statsPathPrefix   = "/_stats/"
 )
 
-// QueuesManager конкурентно безопасен.
-// Содержит в себе мапы с очередями данных и каналов для ожидания новых данных по таймауту.
-// Менеджер не удаляет неиспользуемые очереди!
-type QueuesManager struct {
-	sync.Mutex
-	queues map[string]*queueList
+// Handler обрабатывает входящие запросы.
+type Handler struct {
+	qm *QueuesManager
 }
 
-// queueList содержит в себе данные, либо каналы слушателей ожидающих новые данные.
-type queueList struct {
-	list.List
-	// Флаг который определяет находятся ли в очереди слушатели ожидающие данных
-	listeners bool
-}
+// ServeHTTP обработчик запросов, принимает GET, PUT и POST {queue}/ack.
+// В пути указывается название очереди, куда нужно записать значение, либо получить.
+// При PUT запросе должен присутсвовать параметр "v" (можно указать несколько
+// раз - каждое значение кладется по очереди), который является значением,
+// которое нужно положить в очередь. Параметр "priority" (целое число, чем
+// больше - тем выше приоритет) переводит очередь в приоритетный режим.
+// При GET запросе можно установить параметр "timeout" в секундах, в течении которого
+// приложение будет ожидать нового значения. Если клиент разрывает соединение
+// раньше истечения timeout, ожидание прерывается сразу же. Полученное сообщение
+// не удаляется сразу - оно "в работе", пока не будет подтверждено запросом
+// POST {queue}/ack?id=<id из заголовка Message-Id>, либо не истечет visibility
+// timeout (задается параметром "visibility" в секундах, по умолчанию
+// -visibility), после чего оно возвращается в начало очереди. Параметр "n"
+// у GET включает пакетную выдачу до n сообщений построчным JSON (см.
+// serveGetN). GET {queue}/stream переводит соединение в потоковый режим и
+// отдает NDJSON, пока клиент не отключится (см. serveStream).
+// Оба метода принимают "mode" ("fifo" или "priority"), закрепляющий режим
+// очереди при первом обращении к ней; повторная попытка сменить режим
+// существующей очереди вернет 400. Параметр "maxlen" задает ограничение
+// длины очереди (закрепляется аналогично mode, по умолчанию -maxqueue);
+// Put на заполненную сверх этого предела очередь вернет 503 с Retry-After.
+// Текущее состояние очереди можно посмотреть через GET /_stats/{queue}.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	q := req.URL.Query()
+	mode := q.Get(modeHTTPKey)
 
-// NewQueuesManager возвращает инициализированную очередь.
-func NewQueuesManager() *QueuesManager {
-	list.New()
-	return &QueuesManager{
-		queues: make(map[string]*queueList),
+	if req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, statsPathPrefix) {
+		h.serveStats(w, strings.TrimPrefix(req.URL.Path, statsPathPrefix))
+	} else if req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, streamPathSuffix) {
+		h.serveStream(w, req, strings.TrimSuffix(req.URL.Path, streamPathSuffix), mode)
+	} else if req.Method == http.MethodPut {
+		h.servePut(w, req, mode)
+	} else if req.Method == http.MethodGet && q.Get(getNHTTPKey) != "" {
+		h.serveGetN(w, req, mode)
+	} else if req.Method == http.MethodGet {
+		h.serveGet(w, req, mode)
+	} else if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, ackPathSuffix) {
+		h.serveAck(w, strings.TrimSuffix(req.URL.Path, ackPathSuffix), q.Get(ackIDHTTPKey))
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
 	}
 }
 
-// Put кладет сообщение в очередь, либо сразу отдает ожидающим новых данных.
-func (qm *QueuesManager) Put(qname, value string) {
-	if qname == "" || value == "" {
-		return
-	}
-	qm.Lock()
-	defer qm.Unlock()
-	queue := qm.queues[qname]
-	if queue == nil {
-		queue = &queueList{}
-		queue.PushBack(value)
-		qm.queues[qname] = queue
+// servePut кладет одно или несколько значений (повторяющийся параметр "v")
+// в очередь. Если очередь переполнена, останавливается на первом
+// отклоненном значении и отвечает 503 с Retry-After - уже принятые
+// значения из запроса в очереди остаются.
+func (h *Handler) servePut(w http.ResponseWriter, req *http.Request, mode string) {
+	q := req.URL.Query()
+	values := q[putValueHTTPKey]
+	if len(values) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if queue.listeners {
-		e := queue.Front()
-		e.Value.(chan string) <- value
-		queue.Remove(e)
-		if queue.Len() == 0 {
-			queue.listeners = false
+	var priority *int
+	if p := q.Get(priorityHTTPKey); p != "" {
+		parsed, err := strconv.Atoi(p)
+		if err == nil {
+			priority = &parsed
 		}
-		return
 	}
 
-	queue.PushBack(value)
-}
+	var maxlen *int
+	if l := q.Get(maxlenHTTPKey); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err == nil {
+			maxlen = &parsed
+		}
+	}
 
-// Get получает данные из очереди, если данных нет возращает пустую строку.
-// Если timeout не nil, то ожидает до прихода сообщения, либо до истечения таймаута.
-// Первым сообщение получит тот, кто первее запросил.
-func (qm *QueuesManager) Get(qname string, timeout *time.Duration) string {
-	if qname == "" {
-		return ""
-	}
-	qm.Lock()
-	defer func() {
-		if qm.TryLock() {
-			qm.Unlock()
+	for _, v := range values {
+		if v == "" {
+			continue
 		}
-	}()
-	queue := qm.queues[qname]
-	if queue == nil {
-		queue = &queueList{}
-		qm.queues[qname] = queue
-	}
-	if timeout != nil && (queue.listeners || queue.Len() == 0) {
-		queue.listeners = true // очередь пуста, значит в ней можно хранить каналы слушателей
-		recieveChan := make(chan string)
-		e := queue.PushBack(recieveChan)
-		qm.Unlock()
-		for {
-			select {
-			case v := <-recieveChan:
-				return v
-			case <-time.After(*timeout):
-				qm.Lock()
-				queue.Remove(e)
-				if queue.Len() == 0 {
-					queue.listeners = false
-				}
-				qm.Unlock()
-				return ""
-			}
+		err := h.qm.Put(req.URL.Path, v, priority, mode, maxlen)
+		if full, ok := err.(*ErrQueueFull); ok {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, full.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveGet отдает одно сообщение, ожидая его при необходимости.
+func (h *Handler) serveGet(w http.ResponseWriter, req *http.Request, mode string) {
+	q := req.URL.Query()
+	timeout, visibility := parseGetParams(q)
 
-	e := queue.Front()
-	if e == nil {
-		return ""
+	id, res, err := h.qm.Get(req.Context(), req.URL.Path, timeout, mode, visibility)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if res == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-	v := e.Value.(string)
-	queue.Remove(e)
 
-	return v
+	w.Header().Set("Message-Id", id)
+	if _, err := fmt.Fprint(w, res); err != nil {
+		log.Panicln(err)
+	}
 }
 
-// Handler обрабатывает входящие запросы.
-type Handler struct {
-	qm *QueuesManager
-}
+// serveGetN отдает до n сообщений построчным JSON ({"ID":..,"Value":..} на
+// строку). Если сообщений нет вовсе, отвечает 404, как и обычный GET.
+func (h *Handler) serveGetN(w http.ResponseWriter, req *http.Request, mode string) {
+	q := req.URL.Query()
+	timeout, visibility := parseGetParams(q)
 
-// ServeHTTP обработчик запросов, принимает только GET и PUT.
-// В пути указывается название очереди, куда нужно записать значение, либо получить.
-// При PUT запросе должен присутсвовать параметр "v", которое является значением,
-// которое нужно положить в очередь.
-// При GET запросе можно установить параметр "timeout" в секундах, в течении которого
-// приложение будет ожидать нового значения.
-func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.URL.Path == "/" {
+	n, err := strconv.Atoi(q.Get(getNHTTPKey))
+	if err != nil || n <= 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if req.Method == http.MethodPut {
-		q := req.URL.Query()
-		v := q.Get(putValueHTTPKey)
-		if v == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
 
-		h.qm.Put(req.URL.Path, v)
-		w.WriteHeader(http.StatusOK)
-	} else if req.Method == http.MethodGet {
-		q := req.URL.Query()
-		v := q.Get(getTimeoutHTTPKey)
-		timeout := new(time.Duration)
-		if v != "" {
-			t, err := strconv.Atoi(v)
-			if err == nil {
-				d := time.Second * time.Duration(t)
-				timeout = &d
-			}
+	items, err := h.qm.GetN(req.Context(), req.URL.Path, n, timeout, mode, visibility)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			log.Panicln(err)
 		}
+	}
+}
+
+// serveStream переводит соединение в потоковый режим: подписывается на
+// очередь qname и отдает каждое пришедшее сообщение отдельной строкой
+// NDJSON, пока клиент не отключится.
+func (h *Handler) serveStream(w http.ResponseWriter, req *http.Request, qname, mode string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "потоковая выдача не поддерживается", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-		res := h.qm.Get(req.URL.Path, timeout)
-		if res == "" {
-			w.WriteHeader(http.StatusNotFound)
+	for value := range h.qm.Subscribe(req.Context(), qname, mode) {
+		if _, err := fmt.Fprintln(w, value); err != nil {
 			return
 		}
+		flusher.Flush()
+	}
+}
 
-		_, err := fmt.Fprint(w, res)
-		if err != nil {
-			log.Panicln(err)
-		}
-	} else {
+// serveAck подтверждает обработку сообщения id из очереди qname.
+func (h *Handler) serveAck(w http.ResponseWriter, qname, id string) {
+	if qname == "" || id == "" {
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+
+	if err := h.qm.Ack(qname, id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
+// parseGetParams разбирает общие для GET и n-пакетного GET параметры
+// "timeout" и "visibility".
+func parseGetParams(q url.Values) (timeout *time.Duration, visibility time.Duration) {
+	if v := q.Get(getTimeoutHTTPKey); v != "" {
+		if t, err := strconv.Atoi(v); err == nil {
+			d := time.Second * time.Duration(t)
+			timeout = &d
+		}
+	}
+	if v := q.Get(visibilityHTTPKey); v != "" {
+		if t, err := strconv.Atoi(v); err == nil {
+			visibility = time.Second * time.Duration(t)
+		}
+	}
+	return timeout, visibility
+}
+
+// serveStats отдает JSON со снимком состояния очереди qname: длина,
+// количество слушателей, суммарные put/get и количество отброшенных
+// из-за переполнения сообщений.
+func (h *Handler) serveStats(w http.ResponseWriter, qname string) {
+	stats, err := h.qm.Stats(qname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Panicln(err)
+	}
+}
+
+var (
+	dbPath            = flag.String("db", "", "путь к файлу персистентного хранилища (embedded KV store). Если пусто - хранилище в памяти")
+	dbCacheSize       = flag.Int("cachesize", 1024*1024, "размер write-буфера embedded KV store в байтах")
+	defaultMode       = flag.String("mode", ModeFIFO, "режим по умолчанию для очередей, не указавших ?mode= явно: fifo или priority")
+	defaultVisibility = flag.Int("visibility", 30, "время в секундах, в течение которого отданное Get сообщение считается в работе, если не переопределено параметром ?visibility=")
+	defaultMaxQueue   = flag.Int("maxqueue", 0, "максимальная длина очереди, не указавшей ?maxlen= явно. 0 - без ограничения")
+)
+
 func main() {
+	flag.Parse()
+
 	port := defaultPort
-	// Если нужно указать порт, то он вводится первым аргуметом
-	if len(os.Args) == 2 {
-		portArg := os.Args[1]
+	// Если нужно указать порт, то он вводится первым позиционным аргуметом
+	if args := flag.Args(); len(args) == 1 {
 		var err error
-		port, err = strconv.Atoi(portArg)
+		port, err = strconv.Atoi(args[0])
 		if err != nil {
 			log.Fatalf(
 				"Введите порт на котором должено работать приложени первым аргументом. Ошибка: %v",
@@ -188,8 +274,22 @@ func main() {
 		}
 	}
 
+	store, err := newStorage(*dbPath, *dbCacheSize)
+	if err != nil {
+		log.Fatalf("инициализация хранилища: %v", err)
+	}
+	defer store.Close()
+
 	log.Println(
 		http.ListenAndServe(fmt.Sprintf("127.0.0.1:%v", port),
-			&Handler{qm: NewQueuesManager()}),
+			&Handler{qm: NewQueuesManager(store, *defaultMode, time.Second*time.Duration(*defaultVisibility), *defaultMaxQueue)}),
 	)
 }
+
+// newStorage возвращает boltStorage, если указан path, иначе хранилище в памяти.
+func newStorage(path string, cacheSize int) (Storage, error) {
+	if path == "" {
+		return newMemoryStorage(), nil
+	}
+	return openBoltStorage(path, cacheSize)
+}
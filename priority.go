@@ -0,0 +1,49 @@
+package main
+
+import "container/heap"
+
+// priorityItem - одно сообщение в приоритетной очереди.
+// seq хранит порядковый номер постановки в очередь и разрешает ничьи
+// между сообщениями с одинаковым приоритетом в пользу пришедшего раньше.
+type priorityItem struct {
+	priority int
+	seq      uint64
+	value    string
+}
+
+// priorityHeap - min-heap по приоритету (точнее, max-heap: наверху всегда
+// сообщение с наибольшим priority), реализующий heap.Interface.
+type priorityHeap []*priorityItem
+
+func (h priorityHeap) Len() int { return len(h) }
+
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap) Push(x interface{}) {
+	*h = append(*h, x.(*priorityItem))
+}
+
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// popTop убирает и возвращает сообщение с наивысшим приоритетом.
+// Если куча пуста, ok == false.
+func (h *priorityHeap) popTop() (*priorityItem, bool) {
+	if h.Len() == 0 {
+		return nil, false
+	}
+	return heap.Pop(h).(*priorityItem), true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueuesManagerPriorityOrder(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	low, mid, high := 1, 5, 9
+	if err := qm.Put("q", "low", &low, ModePriority, nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := qm.Put("q", "high", &high, ModePriority, nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := qm.Put("q", "mid", &mid, ModePriority, nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	want := []string{"high", "mid", "low"}
+	for _, w := range want {
+		_, v, err := qm.Get(context.Background(), "q", nil, ModePriority, 0)
+		if err != nil || v != w {
+			t.Fatalf("Get() = %q, %v; want %q, nil", v, err, w)
+		}
+	}
+}
+
+func TestQueuesManagerPriorityTieBrokenByInsertionOrder(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	p := 3
+	if err := qm.Put("q", "first", &p, ModePriority, nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := qm.Put("q", "second", &p, ModePriority, nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	_, v, err := qm.Get(context.Background(), "q", nil, ModePriority, 0)
+	if err != nil || v != "first" {
+		t.Fatalf("Get() = %q, %v; want \"first\", nil", v, err)
+	}
+	_, v, err = qm.Get(context.Background(), "q", nil, ModePriority, 0)
+	if err != nil || v != "second" {
+		t.Fatalf("Get() = %q, %v; want \"second\", nil", v, err)
+	}
+}
+
+func TestQueuesManagerModeMismatchRejected(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	if err := qm.Put("q", "a", nil, ModeFIFO, nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	p := 1
+	if err := qm.Put("q", "b", &p, ModePriority, nil); err == nil {
+		t.Fatal("Put() with mismatched mode = nil error; want error")
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Режимы, в которых может работать очередь. Режим закрепляется за именем
+// очереди при первом Put/Get и не может быть изменен до перезапуска процесса.
+const (
+	ModeFIFO     = "fifo"
+	ModePriority = "priority"
+)
+
+// reapInterval - периодичность, с которой reaper очереди проверяет
+// in-flight сообщения на истечение visibility timeout.
+const reapInterval = time.Second
+
+// delivery - то, что Put передает заблокированному в Get слушателю.
+// priority заполняется только для приоритетных очередей и нужен, чтобы
+// корректно поставить сообщение в in-flight таблицу.
+type delivery struct {
+	value    string
+	priority *int
+}
+
+// inFlightMessage - сообщение, отданное читателю, но еще не подтвержденное.
+// Если visibility timeout истечет раньше Ack, сообщение возвращается в очередь.
+// Хранится только в памяти процесса, а не в Storage: если сервер упадет,
+// пока сообщение в работе, оно будет потеряно - crash-safety, которую дает
+// Storage, распространяется только на то, что еще не было отдано Get/GetN.
+type inFlightMessage struct {
+	qname     string
+	mode      string
+	value     string
+	priority  int
+	seq       uint64
+	expiresAt time.Time
+}
+
+// QueuesManager конкурентно безопасен.
+// Данные FIFO-очередей лежат в Storage (по умолчанию - embedded KV store на диске),
+// а ожидающие новых значений каналы слушателей хранятся только в памяти,
+// так как переживать перезапуск процесса им не нужно. Приоритетные очереди
+// (см. ModePriority) целиком живут в памяти, в priorityQueues.
+// Отданные, но не подтвержденные сообщения живут в inFlight до Ack либо до
+// истечения visibility timeout, когда reaper очереди вернет их в очередь.
+// inFlight живет только в памяти (см. inFlightMessage), поэтому
+// crash-safety, которую дает Storage, на эти сообщения не распространяется.
+// Менеджер не удаляет неиспользуемые очереди!
+type QueuesManager struct {
+	sync.Mutex
+	store             Storage
+	listeners         map[string]*listenerList
+	modes             map[string]string
+	priorityQueues    map[string]*priorityHeap
+	inFlight          map[string]map[string]*inFlightMessage
+	reapersStarted    map[string]bool
+	maxLens           map[string]int
+	putTotal          map[string]uint64
+	getTotal          map[string]uint64
+	dropTotal         map[string]uint64
+	defaultMode       string
+	defaultVisibility time.Duration
+	defaultMaxLen     int
+	seq               uint64
+	idSeq             uint64
+}
+
+// listenerList содержит каналы слушателей, ожидающих новые данные по очереди.
+type listenerList struct {
+	list.List
+}
+
+// NewQueuesManager возвращает инициализированную очередь поверх переданного Storage.
+// defaultMode задает режим, в котором создаются очереди, для которых клиент
+// не указал ?mode= явно. defaultVisibility - время, в течение которого отданное
+// Get сообщение считается "в работе" и не попадет другому читателю, если не
+// переопределено параметром ?visibility= конкретного запроса. defaultMaxLen
+// ограничивает длину очередей, не указавших ?maxlen= явно; 0 означает
+// отсутствие ограничения.
+func NewQueuesManager(store Storage, defaultMode string, defaultVisibility time.Duration, defaultMaxLen int) *QueuesManager {
+	if defaultMode == "" {
+		defaultMode = ModeFIFO
+	}
+	return &QueuesManager{
+		store:             store,
+		listeners:         make(map[string]*listenerList),
+		modes:             make(map[string]string),
+		priorityQueues:    make(map[string]*priorityHeap),
+		inFlight:          make(map[string]map[string]*inFlightMessage),
+		reapersStarted:    make(map[string]bool),
+		maxLens:           make(map[string]int),
+		putTotal:          make(map[string]uint64),
+		getTotal:          make(map[string]uint64),
+		dropTotal:         make(map[string]uint64),
+		defaultMode:       defaultMode,
+		defaultVisibility: defaultVisibility,
+		defaultMaxLen:     defaultMaxLen,
+	}
+}
+
+// resolveMode возвращает режим очереди qname, закрепляя его при первом
+// обращении. Вызывается с удержанием qm.Mutex. Если очередь уже работает
+// в другом режиме, чем запрошено, возвращает ошибку.
+func (qm *QueuesManager) resolveMode(qname, requested string) (string, error) {
+	existing, ok := qm.modes[qname]
+	if !ok {
+		mode := requested
+		if mode == "" {
+			mode = qm.defaultMode
+		}
+		qm.modes[qname] = mode
+		return mode, nil
+	}
+	if requested != "" && requested != existing {
+		return "", fmt.Errorf("очередь %q уже работает в режиме %q, нельзя запросить %q", qname, existing, requested)
+	}
+	return existing, nil
+}
+
+// Put кладет сообщение в очередь, либо сразу отдает ожидающим новых данных.
+// В FIFO-режиме значение сперва фиксируется в Storage, чтобы при сбое сразу
+// после Put сообщение не терялось. В приоритетном режиме priority задает
+// порядок выдачи (больше значение - выше приоритет); при равенстве приоритетов
+// действует обычный FIFO. mode закрепляет режим очереди при первом обращении.
+// maxlen задает ограничение длины очереди, закрепляемое при первом обращении
+// аналогично mode; если очередь уже заполнена до этого предела, Put вернет
+// *ErrQueueFull и не примет сообщение.
+func (qm *QueuesManager) Put(qname, value string, priority *int, mode string, maxlen *int) error {
+	if qname == "" || value == "" {
+		return nil
+	}
+	qm.Lock()
+	defer qm.Unlock()
+
+	m, err := qm.resolveMode(qname, mode)
+	if err != nil {
+		return err
+	}
+
+	listeners := qm.listeners[qname]
+	hasListener := listeners != nil && listeners.Len() > 0
+
+	if !hasListener {
+		if max := qm.maxLenLocked(qname, maxlen); max > 0 {
+			length, lerr := qm.lenLocked(qname, m)
+			if lerr != nil {
+				log.Printf("len %v: %v", qname, lerr)
+			} else if length >= max {
+				qm.dropTotal[qname]++
+				log.Printf("очередь %q заполнена (лимит %d), сообщение отброшено", qname, max)
+				return &ErrQueueFull{Qname: qname, MaxLen: max}
+			}
+		}
+	}
+
+	qm.putTotal[qname]++
+
+	if m == ModePriority {
+		p := 0
+		if priority != nil {
+			p = *priority
+		}
+		qm.seq++
+		pq := qm.priorityQueues[qname]
+		if pq == nil {
+			pq = &priorityHeap{}
+			qm.priorityQueues[qname] = pq
+		}
+		heap.Push(pq, &priorityItem{priority: p, seq: qm.seq, value: value})
+
+		if hasListener {
+			if item, ok := pq.popTop(); ok {
+				e := listeners.Front()
+				listeners.Remove(e)
+				e.Value.(chan delivery) <- delivery{value: item.value, priority: &item.priority}
+			}
+		}
+		return nil
+	}
+
+	if hasListener {
+		e := listeners.Front()
+		listeners.Remove(e)
+		e.Value.(chan delivery) <- delivery{value: value}
+		return nil
+	}
+
+	// Вызывается с удержанием qm.Mutex - см. компромисс в доку tryPop.
+	if err := qm.store.Put(qname, value); err != nil {
+		log.Printf("put %v: %v", qname, err)
+	}
+	return nil
+}
+
+// tryPop атомарно пытается забрать одно сообщение из очереди qname, а если
+// сообщений нет и registerIfEmpty истинен - регистрирует слушателя, не
+// отпуская qm.Mutex между проверкой и регистрацией. Это важно: если бы
+// проверка и регистрация слушателя шли под разными захватами блокировки,
+// конкурентный Put мог бы в промежутке не увидеть еще не зарегистрированного
+// слушателя и положить сообщение в store, а вызывающий после регистрации
+// слушателя ждал бы его до тайм-аута, хотя сообщение все это время лежало
+// в очереди (lost wakeup).
+// Если сообщение забрано, оно, как и в Get, переходит в in-flight.
+// resolvedMode - фактический режим очереди (после resolveMode), возвращается,
+// чтобы вызывающая сторона могла переиспользовать его в последующих
+// обращениях к той же очереди, не разрешая mode заново.
+// Если сообщений нет и зарегистрирован слушатель, возвращает канал, в который
+// придет доставленное значение, и remove - функцию, убирающую слушателя
+// (вызывать при тайм-ауте или отмене ctx).
+// store.PopFront вызывается с удержанием qm.Mutex, так что дисковый I/O
+// boltStorage на время своей транзакции сериализует работу менеджера по
+// всем очередям, а не только по qname - сознательный компромисс в пользу
+// простоты; если это станет узким местом, вызов стоит вынести из-под
+// блокировки (Storage потокобезопасен сам по себе).
+func (qm *QueuesManager) tryPop(qname, mode string, visibility time.Duration, registerIfEmpty bool) (id, value, resolvedMode string, ch chan delivery, remove func(), err error) {
+	qm.Lock()
+	defer qm.Unlock()
+
+	m, err := qm.resolveMode(qname, mode)
+	if err != nil {
+		return "", "", "", nil, nil, err
+	}
+
+	if m == ModePriority {
+		pq := qm.priorityQueues[qname]
+		if pq == nil {
+			pq = &priorityHeap{}
+			qm.priorityQueues[qname] = pq
+		}
+		if item, ok := pq.popTop(); ok {
+			id := qm.trackInFlightLocked(qname, m, item.value, item.priority, item.seq, visibility)
+			return id, item.value, m, nil, nil, nil
+		}
+	} else {
+		v, ok, perr := qm.store.PopFront(qname)
+		if perr != nil {
+			log.Printf("pop %v: %v", qname, perr)
+		}
+		if ok {
+			id := qm.trackInFlightLocked(qname, m, v, 0, 0, visibility)
+			return id, v, m, nil, nil, nil
+		}
+	}
+
+	if !registerIfEmpty {
+		return "", "", m, nil, nil, nil
+	}
+
+	listeners := qm.listeners[qname]
+	if listeners == nil {
+		listeners = &listenerList{}
+		qm.listeners[qname] = listeners
+	}
+	// Канал буферизован на одно значение, чтобы Put/requeue, доставляющие
+	// сообщение напрямую слушателю, никогда не блокировались на отправке -
+	// иначе, удерживая qm.Mutex во время отправки, они рисковали бы
+	// зависнуть навсегда, если получатель к этому моменту уже ушел по
+	// timeout/ctx.Done() (см. drainDelivery в Get).
+	recieveChan := make(chan delivery, 1)
+	e := listeners.PushBack(recieveChan)
+	remove = func() {
+		qm.Lock()
+		listeners.Remove(e)
+		qm.Unlock()
+	}
+	return "", "", m, recieveChan, remove, nil
+}
+
+// Get получает данные из очереди, если данных нет возращает пустую строку.
+// Если timeout не nil, то ожидает до прихода сообщения, либо до истечения таймаута.
+// Ожидание также прерывается отменой ctx - например, при разрыве соединения
+// клиентом - и в этом случае слушатель убирается из очереди немедленно,
+// а не по истечении таймаута.
+// В FIFO-режиме первым сообщение получит тот, кто первее запросил; в
+// приоритетном - отдается сообщение с наивысшим priority.
+// Отданное сообщение не удаляется из очереди немедленно: оно переходит в
+// in-flight до вызова Ack с возвращенным id или до истечения visibility
+// (если передан <=0, используется defaultVisibility). Если id - пустая
+// строка, значит сообщений не было.
+func (qm *QueuesManager) Get(ctx context.Context, qname string, timeout *time.Duration, mode string, visibility time.Duration) (id, value string, err error) {
+	if qname == "" {
+		return "", "", nil
+	}
+	if visibility <= 0 {
+		visibility = qm.defaultVisibility
+	}
+
+	id, value, m, ch, remove, err := qm.tryPop(qname, mode, visibility, timeout != nil)
+	if err != nil {
+		return "", "", err
+	}
+	if value != "" {
+		return id, value, nil
+	}
+	if timeout == nil {
+		return "", "", nil
+	}
+
+	timer := time.NewTimer(*timeout)
+	defer timer.Stop()
+	select {
+	case d := <-ch:
+		return qm.deliver(qname, m, d, visibility), d.value, nil
+	case <-timer.C:
+		remove()
+		if d, ok := drainDelivery(ch); ok {
+			return qm.deliver(qname, m, d, visibility), d.value, nil
+		}
+		return "", "", nil
+	case <-ctx.Done():
+		remove()
+		if d, ok := drainDelivery(ch); ok {
+			return qm.deliver(qname, m, d, visibility), d.value, nil
+		}
+		return "", "", nil
+	}
+}
+
+// drainDelivery неблокирующе проверяет, не успел ли Put/requeue отправить
+// значение в ch между тем, как select в Get выбрал ветку timeout/ctx.Done(),
+// и вызовом remove(). Так как ch буферизован на одно значение (см. tryPop),
+// отправитель не блокируется и такое значение просто лежит в канале, если
+// его никто не забрал - без этой проверки оно было бы потеряно.
+func drainDelivery(ch chan delivery) (delivery, bool) {
+	select {
+	case d := <-ch:
+		return d, true
+	default:
+		return delivery{}, false
+	}
+}
+
+// deliver заносит доставленное слушателю значение в in-flight таблицу
+// и возвращает его id.
+func (qm *QueuesManager) deliver(qname, mode string, d delivery, visibility time.Duration) string {
+	p := 0
+	if d.priority != nil {
+		p = *d.priority
+	}
+	qm.Lock()
+	id := qm.trackInFlightLocked(qname, mode, d.value, p, 0, visibility)
+	qm.Unlock()
+	return id
+}
+
+// BatchItem - одно сообщение, отданное GetN: id для последующего Ack и
+// само значение.
+type BatchItem struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// GetN отдает до n сообщений из очереди qname, каждое переходит в in-flight
+// как и при обычном Get. Если сразу доступно меньше n сообщений и timeout
+// не nil, GetN один раз ждет хотя бы одно сообщение (как Get), а затем
+// добирает оставшиеся без ожидания. Возвращенный слайс может быть короче n
+// или пустым, если сообщений не нашлось.
+func (qm *QueuesManager) GetN(ctx context.Context, qname string, n int, timeout *time.Duration, mode string, visibility time.Duration) ([]BatchItem, error) {
+	if qname == "" || n <= 0 {
+		return nil, nil
+	}
+	if visibility <= 0 {
+		visibility = qm.defaultVisibility
+	}
+
+	var items []BatchItem
+	resolvedMode := mode
+	for len(items) < n {
+		id, value, m, _, _, err := qm.tryPop(qname, resolvedMode, visibility, false)
+		if err != nil {
+			return items, err
+		}
+		resolvedMode = m
+		if value == "" {
+			break
+		}
+		items = append(items, BatchItem{ID: id, Value: value})
+	}
+
+	if len(items) == 0 && timeout != nil {
+		id, value, err := qm.Get(ctx, qname, timeout, resolvedMode, visibility)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			return items, nil
+		}
+		items = append(items, BatchItem{ID: id, Value: value})
+		for len(items) < n {
+			id, value, m, _, _, err := qm.tryPop(qname, resolvedMode, visibility, false)
+			if err != nil {
+				return items, err
+			}
+			resolvedMode = m
+			if value == "" {
+				break
+			}
+			items = append(items, BatchItem{ID: id, Value: value})
+		}
+	}
+	return items, nil
+}
+
+// Subscribe регистрирует долгоживущего слушателя очереди qname и возвращает
+// канал, в который будет приходить каждое новое сообщение (по одному за
+// раз, как и обычным одноразовым Get) до отмены ctx, когда канал закрывается.
+// Слушатель наравне с обычными Get встает в общую очередь ожидания, поэтому
+// стриминговый потребитель не получает приоритета перед одноразовыми.
+// В отличие от Get, доставленные через Subscribe сообщения не попадают в
+// in-flight и не требуют Ack - подписка предназначена для потоковой выдачи,
+// а не для семантики at-least-once.
+func (qm *QueuesManager) Subscribe(ctx context.Context, qname, mode string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for {
+			qm.Lock()
+			m, err := qm.resolveMode(qname, mode)
+			if err != nil {
+				qm.Unlock()
+				return
+			}
+			listeners := qm.listeners[qname]
+			if listeners == nil {
+				listeners = &listenerList{}
+				qm.listeners[qname] = listeners
+			}
+			// Буферизован на одно значение по той же причине, что и в
+			// tryPop: отправитель (Put/requeue) не должен блокироваться,
+			// удерживая qm.Mutex, если эта горутина уйдет по ctx.Done()
+			// раньше, чем успеет его прочитать.
+			recieveChan := make(chan delivery, 1)
+			e := listeners.PushBack(recieveChan)
+			qm.Unlock()
+
+			select {
+			case d := <-recieveChan:
+				select {
+				case out <- d.value:
+				case <-ctx.Done():
+					qm.returnDelivery(qname, m, d)
+					return
+				}
+			case <-ctx.Done():
+				qm.Lock()
+				listeners.Remove(e)
+				qm.Unlock()
+				if d, ok := drainDelivery(recieveChan); ok {
+					qm.returnDelivery(qname, m, d)
+				}
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// trackInFlightLocked заносит отданное читателю сообщение в in-flight
+// таблицу и запускает reaper очереди, если он еще не запущен.
+// Вызывается с удержанием qm.Mutex.
+func (qm *QueuesManager) trackInFlightLocked(qname, mode, value string, priority int, seq uint64, visibility time.Duration) string {
+	qm.idSeq++
+	id := strconv.FormatUint(qm.idSeq, 36)
+	qm.getTotal[qname]++
+
+	msgs := qm.inFlight[qname]
+	if msgs == nil {
+		msgs = make(map[string]*inFlightMessage)
+		qm.inFlight[qname] = msgs
+	}
+	msgs[id] = &inFlightMessage{
+		qname:     qname,
+		mode:      mode,
+		value:     value,
+		priority:  priority,
+		seq:       seq,
+		expiresAt: time.Now().Add(visibility),
+	}
+
+	if !qm.reapersStarted[qname] {
+		qm.reapersStarted[qname] = true
+		go qm.reapLoop(qname)
+	}
+	return id
+}
+
+// Ack подтверждает обработку сообщения id из очереди qname и окончательно
+// убирает его из in-flight таблицы. Возвращает ошибку, если такого
+// сообщения нет - оно уже подтверждено, истекло, либо id неверный.
+func (qm *QueuesManager) Ack(qname, id string) error {
+	qm.Lock()
+	defer qm.Unlock()
+	msgs := qm.inFlight[qname]
+	if msgs == nil {
+		return fmt.Errorf("неизвестное сообщение %q", id)
+	}
+	if _, ok := msgs[id]; !ok {
+		return fmt.Errorf("неизвестное сообщение %q", id)
+	}
+	delete(msgs, id)
+	return nil
+}
+
+// reapLoop периодически проверяет in-flight сообщения очереди qname и
+// возвращает в очередь те, у которых истек visibility timeout. Работает,
+// пока жив процесс - менеджер не удаляет неиспользуемые очереди, поэтому
+// и reaper для них не останавливается.
+func (qm *QueuesManager) reapLoop(qname string) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		qm.Lock()
+		msgs := qm.inFlight[qname]
+		var expired []*inFlightMessage
+		now := time.Now()
+		for id, msg := range msgs {
+			if now.After(msg.expiresAt) {
+				expired = append(expired, msg)
+				delete(msgs, id)
+			}
+		}
+		qm.Unlock()
+
+		for _, msg := range expired {
+			qm.requeue(msg)
+		}
+	}
+}
+
+// requeue возвращает неподтвержденное сообщение в начало очереди - перед
+// уже лежащими там сообщениями. В приоритетном режиме оно возвращается на
+// heap с тем же priority и seq, что и изначально, так что относительно
+// сообщений того же приоритета оно снова окажется первым.
+func (qm *QueuesManager) requeue(msg *inFlightMessage) {
+	qm.Lock()
+	defer qm.Unlock()
+	qm.returnToFrontLocked(msg.qname, msg.mode, msg.value, msg.priority, msg.seq)
+}
+
+// returnDelivery кладет значение, уже отправленное слушателю Get/Subscribe,
+// обратно в начало очереди - вызывается, когда гонка с таймаутом/отменой ctx
+// не дала получателю забрать это значение (см. drainDelivery), чтобы оно не
+// терялось. В приоритетном режиме seq не сохраняется, так как delivery его
+// не несет - сама гонка редка, поэтому возможная перестановка относительно
+// сообщений того же priority, пришедших позже, не страшна.
+func (qm *QueuesManager) returnDelivery(qname, mode string, d delivery) {
+	p := 0
+	if d.priority != nil {
+		p = *d.priority
+	}
+
+	qm.Lock()
+	defer qm.Unlock()
+	var seq uint64
+	if mode == ModePriority {
+		qm.seq++
+		seq = qm.seq
+	}
+	qm.returnToFrontLocked(qname, mode, d.value, p, seq)
+}
+
+// returnToFrontLocked возвращает значение в начало очереди qname - отдает
+// его напрямую ожидающему слушателю, если такой есть, иначе кладет обратно
+// в priorityQueues/store. Вызывается с удержанием qm.Mutex.
+func (qm *QueuesManager) returnToFrontLocked(qname, mode, value string, priority int, seq uint64) {
+	listeners := qm.listeners[qname]
+	hasListener := listeners != nil && listeners.Len() > 0
+
+	if mode == ModePriority {
+		if hasListener {
+			e := listeners.Front()
+			listeners.Remove(e)
+			e.Value.(chan delivery) <- delivery{value: value, priority: &priority}
+			return
+		}
+		pq := qm.priorityQueues[qname]
+		if pq == nil {
+			pq = &priorityHeap{}
+			qm.priorityQueues[qname] = pq
+		}
+		heap.Push(pq, &priorityItem{priority: priority, seq: seq, value: value})
+		return
+	}
+
+	if hasListener {
+		e := listeners.Front()
+		listeners.Remove(e)
+		e.Value.(chan delivery) <- delivery{value: value}
+		return
+	}
+	if err := qm.store.PutFront(qname, value); err != nil {
+		log.Printf("requeue %v: %v", qname, err)
+	}
+}
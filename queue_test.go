@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueuesManagerPutGetFIFO(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	if err := qm.Put("q", "a", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := qm.Put("q", "b", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	_, v, err := qm.Get(context.Background(), "q", nil, "", 0)
+	if err != nil || v != "a" {
+		t.Fatalf("Get() = %q, %v; want \"a\", nil", v, err)
+	}
+	_, v, err = qm.Get(context.Background(), "q", nil, "", 0)
+	if err != nil || v != "b" {
+		t.Fatalf("Get() = %q, %v; want \"b\", nil", v, err)
+	}
+
+	_, v, err = qm.Get(context.Background(), "q", nil, "", 0)
+	if err != nil || v != "" {
+		t.Fatalf("Get() on empty queue = %q, %v; want \"\", nil", v, err)
+	}
+}
+
+func TestQueuesManagerGetBlocksUntilPut(t *testing.T) {
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	timeout := 2 * time.Second
+	result := make(chan string, 1)
+	go func() {
+		_, v, err := qm.Get(context.Background(), "q", &timeout, "", 0)
+		if err != nil {
+			t.Errorf("Get: %v", err)
+			return
+		}
+		result <- v
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := qm.Put("q", "delivered", nil, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	select {
+	case v := <-result:
+		if v != "delivered" {
+			t.Fatalf("Get() = %q; want \"delivered\"", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get did not unblock after Put")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestQueuesManagerGetCancelRaceDoesNotDeadlockOrLoseMessages - регрессионный
+// тест на гонку между доставкой (Put) и отменой ожидания в Get (ctx.Done()
+// или timeout). До исправления select мог выбрать ветку отмены, даже когда
+// отправитель уже писал в канал - тот блокировался на отправке, удерживая
+// qm.Mutex, и вешал весь менеджер; либо сообщение просто терялось.
+func TestQueuesManagerGetCancelRaceDoesNotDeadlockOrLoseMessages(t *testing.T) {
+	const rounds = 200
+	qm := NewQueuesManager(newMemoryStorage(), ModeFIFO, time.Second, 0)
+
+	for i := 0; i < rounds; i++ {
+		qname := fmt.Sprintf("q%d", i)
+		ctx, cancel := context.WithCancel(context.Background())
+		timeout := time.Second
+
+		type getResult struct {
+			value string
+			err   error
+		}
+		resultCh := make(chan getResult, 1)
+		go func() {
+			_, v, err := qm.Get(ctx, qname, &timeout, "", 0)
+			resultCh <- getResult{v, err}
+		}()
+
+		// Дать горутине время зарегистрироваться слушателем, прежде чем
+		// одновременно отменять ctx и класть сообщение.
+		time.Sleep(time.Millisecond)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cancel()
+		}()
+		go func() {
+			defer wg.Done()
+			if err := qm.Put(qname, "v", nil, "", nil); err != nil {
+				t.Errorf("round %d: Put: %v", i, err)
+			}
+		}()
+		wg.Wait()
+
+		var res getResult
+		select {
+		case res = <-resultCh:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: Get deadlocked racing cancel against Put", i)
+		}
+		if res.err != nil {
+			t.Fatalf("round %d: Get: %v", i, res.err)
+		}
+
+		// Сообщение не должно теряться: оно либо досталось этому Get, либо
+		// осталось доступным следующему.
+		if res.value == "" {
+			_, v, err := qm.Get(context.Background(), qname, nil, "", 0)
+			if err != nil {
+				t.Fatalf("round %d: Get: %v", i, err)
+			}
+			if v == "" {
+				t.Fatalf("round %d: message lost in cancel/Put race", i)
+			}
+		}
+
+		// Если отправитель завис на отправке в канал, удерживая qm.Mutex,
+		// этот вызов никогда не вернется.
+		statsDone := make(chan struct{})
+		go func() {
+			qm.Stats(qname)
+			close(statsDone)
+		}()
+		select {
+		case <-statsDone:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: qm.Mutex appears wedged after cancel/Put race", i)
+		}
+	}
+}
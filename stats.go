@@ -0,0 +1,80 @@
+package main
+
+import "fmt"
+
+// ErrQueueFull возвращается Put, когда очередь достигла лимита длины и
+// не может принять новое сообщение без отбрасывания уже лежащих.
+type ErrQueueFull struct {
+	Qname  string
+	MaxLen int
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("очередь %q заполнена (лимит %d)", e.Qname, e.MaxLen)
+}
+
+// QueueStats - снимок состояния одной очереди для GET /_stats/{queue}.
+type QueueStats struct {
+	Length    int    `json:"length"`
+	Listeners int    `json:"listeners"`
+	Puts      uint64 `json:"puts"`
+	Gets      uint64 `json:"gets"`
+	Drops     uint64 `json:"drops"`
+}
+
+// maxLenLocked возвращает ограничение длины очереди qname, закрепляя его
+// при первом обращении: requested, если передан, иначе defaultMaxLen.
+// 0 означает отсутствие ограничения. Вызывается с удержанием qm.Mutex.
+func (qm *QueuesManager) maxLenLocked(qname string, requested *int) int {
+	if v, ok := qm.maxLens[qname]; ok {
+		return v
+	}
+	v := qm.defaultMaxLen
+	if requested != nil {
+		v = *requested
+	}
+	qm.maxLens[qname] = v
+	return v
+}
+
+// lenLocked возвращает количество сообщений, ожидающих в очереди qname (без
+// учета in-flight). Вызывается с удержанием qm.Mutex - для FIFO это значит,
+// что store.Len (диск для boltStorage) выполняется под общей блокировкой
+// менеджера, см. компромисс в доку tryPop.
+func (qm *QueuesManager) lenLocked(qname, mode string) (int, error) {
+	if mode == ModePriority {
+		if pq := qm.priorityQueues[qname]; pq != nil {
+			return pq.Len(), nil
+		}
+		return 0, nil
+	}
+	return qm.store.Len(qname)
+}
+
+// Stats возвращает текущее состояние очереди qname.
+func (qm *QueuesManager) Stats(qname string) (QueueStats, error) {
+	qm.Lock()
+	defer qm.Unlock()
+
+	mode := qm.modes[qname]
+	if mode == "" {
+		mode = qm.defaultMode
+	}
+	length, err := qm.lenLocked(qname, mode)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	listeners := 0
+	if ll := qm.listeners[qname]; ll != nil {
+		listeners = ll.Len()
+	}
+
+	return QueueStats{
+		Length:    length,
+		Listeners: listeners,
+		Puts:      qm.putTotal[qname],
+		Gets:      qm.getTotal[qname],
+		Drops:     qm.dropTotal[qname],
+	}, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Storage хранит значения очередей отдельно от менеджера, чтобы данные
+// переживали перезапуск процесса и не были ограничены объемом оперативной памяти.
+// Реализация по умолчанию (boltStorage) пишет в embedded KV store на диске,
+// memoryStorage используется в тестах и когда флаг -db не указан.
+// Реализации сами отвечают за потокобезопасность: QueuesManager вызывает их
+// методы, удерживая qm.Mutex (см. tryPop, Put, lenLocked), так что на
+// практике обращения к одному Storage сериализуются ею же - собственная
+// блокировка важна, когда к Storage обращаются напрямую, в обход менеджера.
+type Storage interface {
+	// Put кладет значение в конец очереди qname.
+	Put(qname, value string) error
+	// PutFront кладет значение в начало очереди qname, перед уже лежащими
+	// там значениями. Используется при возврате в очередь неподтвержденных
+	// (не acked) сообщений - они должны достаться следующему читателю раньше
+	// новых сообщений.
+	PutFront(qname, value string) error
+	// PopFront забирает и удаляет первое значение очереди qname.
+	// Если очередь пуста, ok == false.
+	PopFront(qname string) (value string, ok bool, err error)
+	// Len возвращает количество значений, ожидающих в очереди qname.
+	Len(qname string) (int, error)
+	// Close освобождает ресурсы, занятые хранилищем.
+	Close() error
+}
+
+// memoryStorage хранит очереди в памяти, используя map очередей значений.
+// Подходит для тестов и запуска без флага -db. front хранит значения,
+// возвращенные в очередь после истечения visibility timeout - они
+// вычитываются раньше основной очереди.
+type memoryStorage struct {
+	sync.Mutex
+	queues map[string][]string
+	front  map[string][]string
+}
+
+// newMemoryStorage возвращает пустое инициализированное хранилище в памяти.
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		queues: make(map[string][]string),
+		front:  make(map[string][]string),
+	}
+}
+
+func (s *memoryStorage) Put(qname, value string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.queues[qname] = append(s.queues[qname], value)
+	return nil
+}
+
+func (s *memoryStorage) PutFront(qname, value string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.front[qname] = append(s.front[qname], value)
+	return nil
+}
+
+func (s *memoryStorage) PopFront(qname string) (string, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if front := s.front[qname]; len(front) > 0 {
+		value := front[0]
+		s.front[qname] = front[1:]
+		return value, true, nil
+	}
+	values := s.queues[qname]
+	if len(values) == 0 {
+		return "", false, nil
+	}
+	value := values[0]
+	s.queues[qname] = values[1:]
+	return value, true, nil
+}
+
+func (s *memoryStorage) Len(qname string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.queues[qname]) + len(s.front[qname]), nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// boltStorage хранит очереди в embedded KV store (bbolt), по одному bucket'у
+// на очередь. Внутри bucket'а курсоры "putpos"/"getpos" (по аналогии с
+// httpmq) хранят позиции записи и чтения, а каждое сообщение лежит под
+// ключом - big-endian представлением своей позиции.
+type boltStorage struct {
+	db *bolt.DB
+}
+
+var (
+	putPosKey      = []byte("putpos")
+	getPosKey      = []byte("getpos")
+	frontPutPosKey = []byte("frontputpos")
+	frontGetPosKey = []byte("frontgetpos")
+)
+
+// frontKey строит ключ для значения, возвращенного в начало очереди.
+// Префикс "f" отличает его длиной (9 байт) от обычных 8-байтовых
+// позиционных ключей, так что namespace'ы не пересекаются.
+func frontKey(pos uint64) []byte {
+	return append([]byte("f"), encodeUint64(pos)...)
+}
+
+// openBoltStorage открывает (создавая при необходимости) файл БД по пути path.
+// cacheSize задает размер внутреннего write-буфера bbolt в байтах.
+func openBoltStorage(path string, cacheSize int) (*boltStorage, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("открытие %v: %w", path, err)
+	}
+	db.MaxBatchSize = cacheSize
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) Put(qname, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(qname))
+		if err != nil {
+			return err
+		}
+		pos := decodeUint64(bucket.Get(putPosKey))
+		if err := bucket.Put(encodeUint64(pos), []byte(value)); err != nil {
+			return err
+		}
+		return bucket.Put(putPosKey, encodeUint64(pos+1))
+	})
+}
+
+func (s *boltStorage) PutFront(qname, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(qname))
+		if err != nil {
+			return err
+		}
+		pos := decodeUint64(bucket.Get(frontPutPosKey))
+		if err := bucket.Put(frontKey(pos), []byte(value)); err != nil {
+			return err
+		}
+		return bucket.Put(frontPutPosKey, encodeUint64(pos+1))
+	})
+}
+
+func (s *boltStorage) PopFront(qname string) (string, bool, error) {
+	var value string
+	var ok bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(qname))
+		if bucket == nil {
+			return nil
+		}
+		frontGetPos := decodeUint64(bucket.Get(frontGetPosKey))
+		frontPutPos := decodeUint64(bucket.Get(frontPutPosKey))
+		if frontGetPos < frontPutPos {
+			key := frontKey(frontGetPos)
+			v := bucket.Get(key)
+			if v != nil {
+				value = string(v)
+				ok = true
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+				return bucket.Put(frontGetPosKey, encodeUint64(frontGetPos+1))
+			}
+		}
+
+		getPos := decodeUint64(bucket.Get(getPosKey))
+		putPos := decodeUint64(bucket.Get(putPosKey))
+		if getPos >= putPos {
+			return nil
+		}
+		key := encodeUint64(getPos)
+		v := bucket.Get(key)
+		if v == nil {
+			return nil
+		}
+		value = string(v)
+		ok = true
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		return bucket.Put(getPosKey, encodeUint64(getPos+1))
+	})
+	return value, ok, err
+}
+
+func (s *boltStorage) Len(qname string) (int, error) {
+	var length int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(qname))
+		if bucket == nil {
+			return nil
+		}
+		length = int(decodeUint64(bucket.Get(putPosKey)) - decodeUint64(bucket.Get(getPosKey)))
+		length += int(decodeUint64(bucket.Get(frontPutPosKey)) - decodeUint64(bucket.Get(frontGetPosKey)))
+		return nil
+	})
+	return length, err
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+func encodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func decodeUint64(b []byte) uint64 {
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
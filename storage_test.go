@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStoragePutPopFront(t *testing.T) {
+	s := newMemoryStorage()
+
+	if err := s.Put("q", "a"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.Put("q", "b"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if n, err := s.Len("q"); err != nil || n != 2 {
+		t.Fatalf("Len() = %d, %v; want 2, nil", n, err)
+	}
+
+	v, ok, err := s.PopFront("q")
+	if err != nil || !ok || v != "a" {
+		t.Fatalf("PopFront() = %q, %v, %v; want \"a\", true, nil", v, ok, err)
+	}
+
+	v, ok, err = s.PopFront("q")
+	if err != nil || !ok || v != "b" {
+		t.Fatalf("PopFront() = %q, %v, %v; want \"b\", true, nil", v, ok, err)
+	}
+
+	if _, ok, err := s.PopFront("q"); err != nil || ok {
+		t.Fatalf("PopFront() on empty queue ok = %v, err = %v; want false, nil", ok, err)
+	}
+}
+
+func TestMemoryStoragePutFrontTakesPriority(t *testing.T) {
+	s := newMemoryStorage()
+
+	if err := s.Put("q", "second"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.PutFront("q", "first"); err != nil {
+		t.Fatalf("PutFront: %v", err)
+	}
+
+	v, ok, err := s.PopFront("q")
+	if err != nil || !ok || v != "first" {
+		t.Fatalf("PopFront() = %q, %v, %v; want \"first\", true, nil", v, ok, err)
+	}
+	v, ok, err = s.PopFront("q")
+	if err != nil || !ok || v != "second" {
+		t.Fatalf("PopFront() = %q, %v, %v; want \"second\", true, nil", v, ok, err)
+	}
+}
+
+// TestBoltStoragePersistsAcrossReopen проверяет основную идею chunk0-1 -
+// данные переживают перезапуск процесса: пишем и частично читаем, закрываем
+// базу, открываем заново по тому же пути и убеждаемся, что оставшиеся
+// значения и их порядок никуда не делись.
+func TestBoltStoragePersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	s, err := openBoltStorage(path, 1024)
+	if err != nil {
+		t.Fatalf("openBoltStorage: %v", err)
+	}
+	if err := s.Put("q", "a"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.Put("q", "b"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.PutFront("q", "front"); err != nil {
+		t.Fatalf("PutFront: %v", err)
+	}
+
+	v, ok, err := s.PopFront("q")
+	if err != nil || !ok || v != "front" {
+		t.Fatalf("PopFront() = %q, %v, %v; want \"front\", true, nil", v, ok, err)
+	}
+	if n, err := s.Len("q"); err != nil || n != 2 {
+		t.Fatalf("Len() = %d, %v; want 2, nil", n, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := openBoltStorage(path, 1024)
+	if err != nil {
+		t.Fatalf("openBoltStorage (reopen): %v", err)
+	}
+	defer reopened.Close()
+
+	if n, err := reopened.Len("q"); err != nil || n != 2 {
+		t.Fatalf("Len() после переоткрытия = %d, %v; want 2, nil", n, err)
+	}
+
+	v, ok, err = reopened.PopFront("q")
+	if err != nil || !ok || v != "a" {
+		t.Fatalf("PopFront() после переоткрытия = %q, %v, %v; want \"a\", true, nil", v, ok, err)
+	}
+	v, ok, err = reopened.PopFront("q")
+	if err != nil || !ok || v != "b" {
+		t.Fatalf("PopFront() после переоткрытия = %q, %v, %v; want \"b\", true, nil", v, ok, err)
+	}
+	if _, ok, err := reopened.PopFront("q"); err != nil || ok {
+		t.Fatalf("PopFront() на пустой очереди ok = %v, err = %v; want false, nil", ok, err)
+	}
+}